@@ -2,13 +2,24 @@ package main
 
 import (
 	"bufio"
+	"bytes"
+	"crypto/subtle"
+	"encoding/gob"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"io"
+	"math"
 	"math/rand"
+	"net/http"
 	"os"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
+	"unicode"
+	"unicode/utf8"
 )
 
 // Prefix is a Markov chain prefix of one or more words.
@@ -25,78 +36,569 @@ func (p Prefix) Shift(word string) {
 	p[len(p)-1] = word
 }
 
-// Chain contains a map ("chain") of prefixes to a list of suffixes.
-// A prefix is a string of prefixLen words joined with spaces.
-// A suffix is a single word. A prefix can have multiple suffixes.
+// suffixDist holds the distinct suffixes seen after a prefix, with a
+// count per suffix. Fields are exported so the type round-trips via gob.
+type suffixDist struct {
+	Suffixes []string
+	Counts   []int
+}
+
+// add records an occurrence of suffix.
+func (d *suffixDist) add(suffix string) {
+	for i, s := range d.Suffixes {
+		if s == suffix {
+			d.Counts[i]++
+			return
+		}
+	}
+	d.Suffixes = append(d.Suffixes, suffix)
+	d.Counts = append(d.Counts, 1)
+}
+
+// sample draws a suffix from d, reshaping its counts by temperature:
+// counts are raised to the power 1/temperature before being accumulated
+// into weights, so a temperature below 1 sharpens the distribution
+// toward its most frequent suffixes and a temperature above 1 flattens it
+// toward wilder, less frequent choices. temperature <= 0 is treated as 1.
+func (d *suffixDist) sample(temperature float64) string {
+	if len(d.Suffixes) == 1 {
+		return d.Suffixes[0]
+	}
+	if temperature <= 0 {
+		temperature = 1
+	}
+	weights := make([]float64, len(d.Counts))
+	var cum float64
+	for i, count := range d.Counts {
+		cum += math.Pow(float64(count), 1/temperature)
+		weights[i] = cum
+	}
+	r := rand.Float64() * cum
+	i := sort.Search(len(weights), func(i int) bool { return weights[i] >= r })
+	if i >= len(weights) {
+		i = len(weights) - 1
+	}
+	return d.Suffixes[i]
+}
+
+// Chain contains a map ("chain") of prefixes to the distribution of
+// suffixes observed after them. A prefix is a string of prefixLen words
+// joined with spaces. mu guards chain so a Chain is safe for concurrent use.
 type Chain struct {
-	chain     map[string][]string
+	mu        sync.Mutex
+	chain     map[string]*suffixDist
 	prefixLen int
+
+	// EndOnSentence, when true, makes Generate stop as soon as it reaches
+	// a sentence-terminating token (after at least minSentenceWords
+	// words), instead of running on for the full requested word count.
+	EndOnSentence bool
+
+	// Temperature reshapes suffix sampling: values below 1 favor the most
+	// frequent suffixes, values above 1 flatten the distribution toward
+	// rarer ones. Zero is treated as the neutral value of 1.
+	Temperature float64
 }
 
 // NewChain returns a new Chain with prefixes of prefixLen words.
 func NewChain(prefixLen int) *Chain {
-	return &Chain{make(map[string][]string), prefixLen}
+	return &Chain{chain: make(map[string]*suffixDist), prefixLen: prefixLen, Temperature: 1}
 }
 
-// Build reads text from the provided Reader and
-// parses it into prefixes and suffixes that are stored in Chain.
-func (c *Chain) Build(r io.Reader) {
-	br := bufio.NewReader(r)
-	p := make(Prefix, c.prefixLen)
-	for {
-		var s string
-		if _, err := fmt.Fscan(br, &s); err != nil {
+// minSentenceWords is the minimum number of words Generate produces
+// before EndOnSentence is allowed to stop it early.
+const minSentenceWords = 5
+
+// isSentenceEnd reports whether tok is a sentence-terminating token.
+func isSentenceEnd(tok string) bool {
+	switch tok {
+	case ".", "!", "?":
+		return true
+	}
+	return false
+}
+
+// scanTokens is a bufio.SplitFunc that tokenizes Unicode text into words,
+// splitting sentence-terminating punctuation (. ! ?) into tokens of their
+// own so a Chain can treat them as distinct suffixes rather than as part
+// of the word they follow.
+func scanTokens(data []byte, atEOF bool) (advance int, token []byte, err error) {
+	start := 0
+	for start < len(data) {
+		r, width := utf8.DecodeRune(data[start:])
+		if !unicode.IsSpace(r) {
 			break
 		}
+		start += width
+	}
+	if start >= len(data) {
+		if atEOF {
+			return len(data), nil, nil
+		}
+		return start, nil, nil
+	}
+	if r, width := utf8.DecodeRune(data[start:]); r == '.' || r == '!' || r == '?' {
+		return start + width, data[start : start+width], nil
+	}
+	for i := start; i < len(data); {
+		r, width := utf8.DecodeRune(data[i:])
+		if unicode.IsSpace(r) || r == '.' || r == '!' || r == '?' {
+			return i, data[start:i], nil
+		}
+		i += width
+	}
+	if atEOF {
+		return len(data), data[start:], nil
+	}
+	return start, nil, nil
+}
+
+// joinTokens joins word and punctuation tokens into a string, without a
+// stray space before sentence-terminating punctuation.
+func joinTokens(tokens []string) string {
+	var b strings.Builder
+	for i, t := range tokens {
+		if i > 0 && !isSentenceEnd(t) {
+			b.WriteByte(' ')
+		}
+		b.WriteString(t)
+	}
+	return b.String()
+}
+
+// Build reads text from r and adds its prefixes and suffixes to Chain.
+// The prefix resets to the zero-word sentinel at each sentence boundary.
+func (c *Chain) Build(r io.Reader) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	sc := bufio.NewScanner(r)
+	sc.Split(scanTokens)
+	p := make(Prefix, c.prefixLen)
+	for sc.Scan() {
+		s := sc.Text()
 		key := p.String()
-		c.chain[key] = append(c.chain[key], s)
-		p.Shift(s)
+		dist, ok := c.chain[key]
+		if !ok {
+			dist = &suffixDist{}
+			c.chain[key] = dist
+		}
+		dist.add(s)
+		if isSentenceEnd(s) {
+			p = make(Prefix, c.prefixLen)
+		} else {
+			p.Shift(s)
+		}
 	}
 }
 
-// Generate returns a string of at most n words generated from Chain.
+// Generate returns a string of at most n words generated from Chain. If
+// EndOnSentence is set, generation stops as soon as it reaches a
+// sentence-terminating token after at least minSentenceWords words.
 func (c *Chain) Generate(n int) string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.generate(make(Prefix, c.prefixLen), nil, n)
+}
+
+// GenerateFrom generates up to n words continuing from seed, a string of
+// one or more words. seed is tokenized and used as the initial Prefix; if
+// that exact prefix was never observed during training, GenerateFrom
+// falls back to a random known prefix ending in the last seed word, and
+// if even that isn't found, to the zero prefix (the same starting point
+// as Generate). The seed's own words are included at the start of the
+// returned string.
+func (c *Chain) GenerateFrom(seed string, n int) string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	p, words := c.seedPrefix(seed)
+	return c.generate(p, words, n)
+}
+
+// generate runs the chain forward from p, with words already produced so
+// far, for up to n total words. Callers must hold c.mu.
+func (c *Chain) generate(p Prefix, words []string, n int) string {
+	for i := len(words); i < n; i++ {
+		dist := c.chain[p.String()]
+		if dist == nil {
+			break
+		}
+		next := dist.sample(c.Temperature)
+		words = append(words, next)
+		if isSentenceEnd(next) {
+			if c.EndOnSentence && len(words) >= minSentenceWords {
+				break
+			}
+			p = make(Prefix, c.prefixLen)
+			continue
+		}
+		p.Shift(next)
+	}
+	return joinTokens(words)
+}
+
+// seedPrefix tokenizes seed and returns the Prefix that follows it in the
+// chain, along with seed's own tokens so they can be included in the
+// generated output. Callers must hold c.mu.
+func (c *Chain) seedPrefix(seed string) (Prefix, []string) {
+	var tokens []string
+	sc := bufio.NewScanner(strings.NewReader(seed))
+	sc.Split(scanTokens)
+	for sc.Scan() {
+		tokens = append(tokens, sc.Text())
+	}
+	if len(tokens) == 0 {
+		return make(Prefix, c.prefixLen), nil
+	}
+
+	p := make(Prefix, c.prefixLen)
+	if len(tokens) >= c.prefixLen {
+		copy(p, tokens[len(tokens)-c.prefixLen:])
+	} else {
+		copy(p[c.prefixLen-len(tokens):], tokens)
+	}
+	if _, ok := c.chain[p.String()]; ok {
+		return p, tokens
+	}
+
+	last := tokens[len(tokens)-1]
+	var candidates []string
+	for key := range c.chain {
+		words := strings.Split(key, " ")
+		if words[len(words)-1] == last {
+			candidates = append(candidates, key)
+		}
+	}
+	if len(candidates) == 0 {
+		return make(Prefix, c.prefixLen), tokens
+	}
+	return Prefix(strings.Split(candidates[rand.Intn(len(candidates))], " ")), tokens
+}
+
+// stateMagic and stateVersion identify the on-disk format written by Save
+// and checked by Load, so that Load can refuse a file that isn't a ribbot
+// state file or that was written by an incompatible version.
+const (
+	stateMagic   = 0x5262626f // "Rbbo"
+	stateVersion = 1
+)
+
+// chainState is the gob-encoded representation of a Chain written by Save
+// and read back by Load.
+type chainState struct {
+	Magic     uint32
+	Version   uint32
+	Chain     map[string]*suffixDist
+	PrefixLen int
+}
+
+// Save writes c's state to w as a gob-encoded stream with a version
+// header, so it can be restored later with Load.
+func (c *Chain) Save(w io.Writer) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	state := chainState{
+		Magic:     stateMagic,
+		Version:   stateVersion,
+		Chain:     c.chain,
+		PrefixLen: c.prefixLen,
+	}
+	return gob.NewEncoder(w).Encode(state)
+}
+
+// Load reads a gob-encoded Chain state from r, as written by Save, and
+// replaces c's contents with it.
+func (c *Chain) Load(r io.Reader) error {
+	var state chainState
+	if err := gob.NewDecoder(r).Decode(&state); err != nil {
+		return err
+	}
+	if state.Magic != stateMagic {
+		return fmt.Errorf("ribbing: not a ribbot state file (bad magic %x)", state.Magic)
+	}
+	if state.Version != stateVersion {
+		return fmt.Errorf("ribbing: unsupported state version %d", state.Version)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.chain = state.Chain
+	c.prefixLen = state.PrefixLen
+	return nil
+}
+
+// loadState loads c's state from path if it exists, logging and
+// continuing on error rather than failing startup. It reports whether a
+// state file was actually found and successfully loaded.
+func loadState(c *Chain, path string) bool {
+	f, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	if err := c.Load(f); err != nil {
+		fmt.Fprintln(os.Stderr, "ribbing: loading state:", err)
+		return false
+	}
+	return true
+}
+
+// saveState writes c's state to path, creating or truncating it.
+func saveState(c *Chain, path string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return c.Save(f)
+}
+
+// next samples a suffix following tail, the most recently generated
+// words (which need not number exactly prefixLen; it is zero-padded at
+// the front to fit). It reports false if tail was never observed as a
+// prefix, so callers can back off to a shorter context instead of
+// stopping generation outright.
+func (c *Chain) next(tail []string) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
 	p := make(Prefix, c.prefixLen)
+	if len(tail) >= c.prefixLen {
+		copy(p, tail[len(tail)-c.prefixLen:])
+	} else {
+		copy(p[c.prefixLen-len(tail):], tail)
+	}
+	dist := c.chain[p.String()]
+	if dist == nil {
+		return "", false
+	}
+	return dist.sample(c.Temperature), true
+}
+
+// MultiChain trains chains of every prefix length from 1 up to
+// maxPrefixLen at once, so Generate can back off to a shorter order when
+// the longest one has no suffixes for the current context.
+type MultiChain struct {
+	chains       []*Chain // chains[i] has prefix length i+1
+	maxPrefixLen int
+}
+
+// NewMultiChain returns a MultiChain that trains chains of prefix length
+// 1 through maxPrefixLen.
+func NewMultiChain(maxPrefixLen int) *MultiChain {
+	mc := &MultiChain{maxPrefixLen: maxPrefixLen}
+	for i := 1; i <= maxPrefixLen; i++ {
+		mc.chains = append(mc.chains, NewChain(i))
+	}
+	return mc
+}
+
+// Build reads r once and trains every order's chain in mc from it.
+func (mc *MultiChain) Build(r io.Reader) {
+	data, _ := io.ReadAll(r)
+	for _, c := range mc.chains {
+		c.Build(bytes.NewReader(data))
+	}
+}
+
+// Generate produces up to n words, trying the longest trained order
+// first and backing off to shorter orders, down to minOrder, whenever the
+// current context has no suffixes. It stops only when no order from
+// maxPrefixLen down to minOrder has a suffix for the current context.
+// minOrder is clamped to at least 1.
+func (mc *MultiChain) Generate(n int, minOrder int) string {
+	if minOrder < 1 {
+		minOrder = 1
+	}
 	var words []string
+	var ctx []string
 	for i := 0; i < n; i++ {
-		choices := c.chain[p.String()]
-		if len(choices) == 0 {
+		var next string
+		var found bool
+		for order := mc.maxPrefixLen; order >= minOrder; order-- {
+			next, found = mc.chains[order-1].next(ctx)
+			if found {
+				break
+			}
+		}
+		if !found {
 			break
 		}
-		next := choices[rand.Intn(len(choices))]
 		words = append(words, next)
-		p.Shift(next)
+		if isSentenceEnd(next) {
+			ctx = nil
+		} else {
+			ctx = append(ctx, next)
+		}
+	}
+	return joinTokens(words)
+}
+
+// generateResponse is the JSON body returned by GET /generate.
+type generateResponse struct {
+	Text   string `json:"text"`
+	Seed   string `json:"seed"`
+	Prefix int    `json:"prefix"`
+}
+
+// maxGenerateWords and maxTrainBytes bound the two values a client
+// controls directly, so an unauthenticated caller can't make /generate
+// run unboundedly long or /train grow the chain and its saved state
+// without limit.
+const (
+	maxGenerateWords = 1000
+	maxTrainBytes    = 1 << 20 // 1 MiB
+)
+
+// newMux builds the /generate and /train handlers described on serve.
+func newMux(c *Chain, statePath, trainSecret string) http.Handler {
+	var saveMu sync.Mutex
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/generate", func(w http.ResponseWriter, r *http.Request) {
+		n := 35
+		if v := r.URL.Query().Get("words"); v != "" {
+			if parsed, err := strconv.Atoi(v); err == nil && parsed > 0 {
+				n = parsed
+			}
+		}
+		if n > maxGenerateWords {
+			n = maxGenerateWords
+		}
+		if v := r.URL.Query().Get("prefix"); v != "" {
+			if parsed, err := strconv.Atoi(v); err != nil || parsed != c.prefixLen {
+				http.Error(w, fmt.Sprintf("prefix must be %d", c.prefixLen), http.StatusBadRequest)
+				return
+			}
+		}
+		seed := r.URL.Query().Get("seed")
+		var text string
+		if seed != "" {
+			text = c.GenerateFrom(seed, n)
+		} else {
+			text = c.Generate(n)
+		}
+		writeJSON(w, generateResponse{Text: text, Seed: seed, Prefix: c.prefixLen})
+	})
+
+	mux.HandleFunc("/train", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if trainSecret != "" && subtle.ConstantTimeCompare([]byte(r.Header.Get("X-Ribbot-Secret")), []byte(trainSecret)) != 1 {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		c.Build(http.MaxBytesReader(w, r.Body, maxTrainBytes))
+		if statePath != "" {
+			saveMu.Lock()
+			err := saveState(c, statePath)
+			saveMu.Unlock()
+			if err != nil {
+				http.Error(w, "saving state: "+err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	return mux
+}
+
+// serve starts an HTTP server on addr exposing c for generation and
+// incremental training over GET /generate?words=N&seed=...&prefix=K and
+// POST /train. prefix is optional and must match c's own prefix length;
+// ribbot doesn't yet serve more than one order per process. If statePath
+// is non-empty, c is saved back to it after every successful train.
+func serve(addr string, c *Chain, statePath, trainSecret string) error {
+	server := &http.Server{
+		Addr:              addr,
+		Handler:           newMux(c, statePath, trainSecret),
+		ReadHeaderTimeout: 5 * time.Second,
+		ReadTimeout:       10 * time.Second,
+		WriteTimeout:      10 * time.Second,
+		IdleTimeout:       60 * time.Second,
+	}
+	return server.ListenAndServe()
+}
+
+// writeJSON encodes v as the JSON response body.
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// corpusFiles are the hardcoded Fråga Ribbing source texts, relative to
+// texts/, ingested by ingestCorpus.
+var corpusFiles = []string{"fraga-ribbing-2015-08-14", "fraga-ribbing-2016-05-27", "fraga-ribbing-2015-05-22", "fraga-ribbing-2016-01-08", "fraga-ribbing-2016-03-24", "fraga-ribbing-2016-01-29", "fraga-ribbing-2015-03-06", "fraga-ribbing-2015-01-09", "fraga-ribbing-2014-12-12", "fraga-ribbing-2015-06-05", "fraga-ribbing-2015-01-16", "fraga-ribbing-2014-10-24", "fraga-ribbing-2014-06-13", "fraga-ribbing-2015-04-10", "fraga-ribbing-2015-01-30", "fraga-ribbing-2015-03-13", "fraga-ribbing-2014-08-01", "fraga-ribbing-2014-09-12", "fraga-ribbing-2015-01-23", "fraga-ribbing-2014-09-26", "fraga-ribbing-2014-10-17", "fraga-ribbing-2014-07-04"}
+
+// ingestCorpus builds b from texts/scum.txt and the hardcoded corpusFiles.
+func ingestCorpus(b interface{ Build(io.Reader) }) {
+	scum, _ := os.Open("texts/scum.txt")
+	b.Build(scum)
+
+	for _, item := range corpusFiles {
+		filename := strings.Join([]string{"texts/", item}, "")
+		file, _ := os.Open(filename)
+		b.Build(file)
 	}
-	return strings.Join(words, " ")
 }
 
 func main() {
 	// Register command-line flags.
 	numWords := flag.Int("words", 35, "maximum number of words to print")
 	prefixLen := flag.Int("prefix", 2, "prefix length in words")
+	statePath := flag.String("state", "", "path to a gob-encoded state file; if set, ribbot loads it on startup and saves the updated model back to it before exiting")
+	seed := flag.String("seed", "", "seed text to start generation from; falls back to a random context containing its last word if the seed itself is unseen")
+	temperature := flag.Float64("temperature", 1, "sampling temperature: below 1 favors frequent suffixes, above 1 favors rarer ones")
+	httpAddr := flag.String("http", "", "if set, run an HTTP server on this address exposing /generate and /train instead of printing once and exiting")
+	trainSecret := flag.String("train-secret", "", "if set, required value of the X-Ribbot-Secret header for POST /train")
+	minOrder := flag.Int("minorder", 0, "if > 0 and less than -prefix, generate with MultiChain backoff from -prefix down to this order instead of a single fixed-order chain")
 
 	flag.Parse()                     // Parse command-line flags.
 	rand.Seed(time.Now().UnixNano()) // Seed the random number generator.
 
 	c := NewChain(*prefixLen) // Initialize a new Chain.
-	scum, _ := os.Open("texts/scum.txt")
-	c.Build(scum) // Build chains from standard input.
+	c.EndOnSentence = true
+	c.Temperature = *temperature
 
-	files := []string{"fraga-ribbing-2015-08-14", "fraga-ribbing-2016-05-27", "fraga-ribbing-2015-05-22", "fraga-ribbing-2016-01-08", "fraga-ribbing-2016-03-24", "fraga-ribbing-2016-01-29", "fraga-ribbing-2015-03-06", "fraga-ribbing-2015-01-09", "fraga-ribbing-2014-12-12", "fraga-ribbing-2015-06-05", "fraga-ribbing-2015-01-16", "fraga-ribbing-2014-10-24", "fraga-ribbing-2014-06-13", "fraga-ribbing-2015-04-10", "fraga-ribbing-2015-01-30", "fraga-ribbing-2015-03-13", "fraga-ribbing-2014-08-01", "fraga-ribbing-2014-09-12", "fraga-ribbing-2015-01-23", "fraga-ribbing-2014-09-26", "fraga-ribbing-2014-10-17", "fraga-ribbing-2014-07-04"}
+	// Only ingest the hardcoded corpus files if we didn't load an
+	// existing model: that's the whole point of -state, to let ribbot
+	// train incrementally instead of re-reading the same 22 files (and
+	// re-inflating their counts) on every run.
+	if *statePath == "" || !loadState(c, *statePath) {
+		ingestCorpus(c)
+	}
 
-	for _, item := range files {
-		filename := strings.Join([]string{"texts/", item}, "")
-		file, _ := os.Open(string(filename))
-		c.Build(file)
+	if *statePath != "" {
+		if err := saveState(c, *statePath); err != nil {
+			fmt.Fprintln(os.Stderr, "ribbing: saving state:", err)
+		}
+	}
+
+	if *httpAddr != "" {
+		if err := serve(*httpAddr, c, *statePath, *trainSecret); err != nil {
+			fmt.Fprintln(os.Stderr, "ribbing:", err)
+			os.Exit(1)
+		}
+		return
 	}
 
-	text := c.Generate(*numWords) // Generate text.
-	strippedText := strings.Split(text, ".")
-	strippedText = strippedText[:len(strippedText)-1]
+	var mc *MultiChain
+	if *seed == "" && *minOrder > 0 && *minOrder < *prefixLen {
+		mc = NewMultiChain(*prefixLen)
+		ingestCorpus(mc)
+	}
 
-	text = strings.Join(strippedText, ".")
+	var text string
+	switch {
+	case *seed != "":
+		text = c.GenerateFrom(*seed, *numWords)
+	case mc != nil:
+		text = mc.Generate(*numWords, *minOrder)
+	default:
+		text = c.Generate(*numWords)
+	}
 
-	fmt.Print(text) // Write text to standard output.
-	fmt.Print(".")
-	fmt.Println("")
+	fmt.Println(text) // Write text to standard output.
 }
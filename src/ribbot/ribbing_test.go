@@ -0,0 +1,301 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestChainSaveLoadRoundTrip(t *testing.T) {
+	c := NewChain(2)
+	c.Build(strings.NewReader("the quick brown fox jumps over the lazy dog."))
+
+	var buf bytes.Buffer
+	if err := c.Save(&buf); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+
+	loaded := NewChain(1) // deliberately different prefixLen; Load should restore it
+	if err := loaded.Load(&buf); err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if loaded.prefixLen != c.prefixLen {
+		t.Fatalf("prefixLen = %d, want %d", loaded.prefixLen, c.prefixLen)
+	}
+	if len(loaded.chain) != len(c.chain) {
+		t.Fatalf("len(chain) = %d, want %d", len(loaded.chain), len(c.chain))
+	}
+}
+
+func TestChainLoadRejectsBadMagic(t *testing.T) {
+	c := NewChain(2)
+	if err := c.Load(strings.NewReader("not a gob stream")); err == nil {
+		t.Fatal("Load: expected error for garbage input, got nil")
+	}
+}
+
+func scanAll(t *testing.T, text string) []string {
+	t.Helper()
+	sc := bufio.NewScanner(strings.NewReader(text))
+	sc.Split(scanTokens)
+	var tokens []string
+	for sc.Scan() {
+		tokens = append(tokens, sc.Text())
+	}
+	if err := sc.Err(); err != nil {
+		t.Fatalf("scan: %v", err)
+	}
+	return tokens
+}
+
+func TestScanTokens(t *testing.T) {
+	tests := []struct {
+		text string
+		want []string
+	}{
+		{"hello world", []string{"hello", "world"}},
+		{"hello.", []string{"hello", "."}},
+		{"Wait! Really?", []string{"Wait", "!", "Really", "?"}},
+		{"  leading   and trailing  ", []string{"leading", "and", "trailing"}},
+		{"över huvudvärk.", []string{"över", "huvudvärk", "."}},
+		{"", nil},
+	}
+	for _, tt := range tests {
+		got := scanAll(t, tt.text)
+		if !equalStrings(got, tt.want) {
+			t.Errorf("scanTokens(%q) = %v, want %v", tt.text, got, tt.want)
+		}
+	}
+}
+
+func TestIsSentenceEnd(t *testing.T) {
+	for _, tok := range []string{".", "!", "?"} {
+		if !isSentenceEnd(tok) {
+			t.Errorf("isSentenceEnd(%q) = false, want true", tok)
+		}
+	}
+	for _, tok := range []string{"", "hello", ",", "..."} {
+		if isSentenceEnd(tok) {
+			t.Errorf("isSentenceEnd(%q) = true, want false", tok)
+		}
+	}
+}
+
+func TestJoinTokens(t *testing.T) {
+	got := joinTokens([]string{"hello", "world", ".", "Bye", "!"})
+	want := "hello world. Bye!"
+	if got != want {
+		t.Errorf("joinTokens = %q, want %q", got, want)
+	}
+}
+
+func TestSeedPrefixExactMatch(t *testing.T) {
+	c := NewChain(1)
+	c.Build(strings.NewReader("the cat sat on the mat."))
+
+	p, tokens := c.seedPrefix("cat")
+	if !equalStrings(tokens, []string{"cat"}) {
+		t.Fatalf("tokens = %v, want [cat]", tokens)
+	}
+	if p.String() != "cat" {
+		t.Fatalf("seedPrefix(%q) = %q, want exact match %q", "cat", p.String(), "cat")
+	}
+}
+
+func TestSeedPrefixFallsBackOnLastWord(t *testing.T) {
+	c := NewChain(2)
+	c.Build(strings.NewReader("red fox jumps. blue fox runs."))
+
+	p, tokens := c.seedPrefix("green fox")
+	if !equalStrings(tokens, []string{"green", "fox"}) {
+		t.Fatalf("tokens = %v, want [green fox]", tokens)
+	}
+	switch p.String() {
+	case "red fox", "blue fox":
+	default:
+		t.Fatalf("seedPrefix(%q) = %q, want a known prefix ending in %q", "green fox", p.String(), "fox")
+	}
+}
+
+func TestSeedPrefixFallsBackToZero(t *testing.T) {
+	c := NewChain(1)
+	c.Build(strings.NewReader("the cat sat."))
+
+	p, tokens := c.seedPrefix("dog")
+	if !equalStrings(tokens, []string{"dog"}) {
+		t.Fatalf("tokens = %v, want [dog]", tokens)
+	}
+	if p.String() != "" {
+		t.Fatalf("seedPrefix(%q) = %q, want the zero prefix", "dog", p.String())
+	}
+}
+
+func TestSuffixDistSampleSingleSuffix(t *testing.T) {
+	d := &suffixDist{}
+	d.add("only")
+	for i := 0; i < 5; i++ {
+		if got := d.sample(1); got != "only" {
+			t.Fatalf("sample = %q, want %q", got, "only")
+		}
+	}
+}
+
+func TestSuffixDistSampleFavorsFrequentSuffix(t *testing.T) {
+	d := &suffixDist{}
+	for i := 0; i < 90; i++ {
+		d.add("common")
+	}
+	for i := 0; i < 10; i++ {
+		d.add("rare")
+	}
+
+	const trials = 2000
+	var commonCount int
+	for i := 0; i < trials; i++ {
+		if d.sample(1) == "common" {
+			commonCount++
+		}
+	}
+	if got := float64(commonCount) / trials; got < 0.75 {
+		t.Fatalf("common suffix (90/10 counts) sampled %.2f of the time, want >= 0.75", got)
+	}
+}
+
+func TestSuffixDistSampleTemperatureFlattensDistribution(t *testing.T) {
+	d := &suffixDist{}
+	for i := 0; i < 90; i++ {
+		d.add("common")
+	}
+	for i := 0; i < 10; i++ {
+		d.add("rare")
+	}
+
+	const trials = 2000
+	var rareAtT1, rareAtHighT int
+	for i := 0; i < trials; i++ {
+		if d.sample(1) == "rare" {
+			rareAtT1++
+		}
+		if d.sample(5) == "rare" {
+			rareAtHighT++
+		}
+	}
+	if rareAtHighT <= rareAtT1 {
+		t.Fatalf("rare suffix sampled %d/%d times at temperature 5 vs %d/%d at temperature 1, want higher temperature to favor it more", rareAtHighT, trials, rareAtT1, trials)
+	}
+}
+
+func TestMultiChainGenerateClampsMinOrder(t *testing.T) {
+	mc := NewMultiChain(2)
+	mc.Build(strings.NewReader("alpha beta gamma delta epsilon zeta uniqueendtoken"))
+
+	// Previously panicked with "index out of range [-1]" once every
+	// trained order was exhausted and minOrder was <= 0.
+	mc.Generate(500, 0)
+}
+
+func TestMultiChainGenerateBacksOffToShorterOrder(t *testing.T) {
+	mc := NewMultiChain(2)
+	// order-2 (chains[1]) never saw any context, so it always misses;
+	// order-1 (chains[0]) has a two-step deterministic path.
+	mc.chains[0].chain[""] = &suffixDist{Suffixes: []string{"start"}, Counts: []int{1}}
+	mc.chains[0].chain["start"] = &suffixDist{Suffixes: []string{"followup"}, Counts: []int{1}}
+
+	got := mc.Generate(2, 1)
+	want := "start followup"
+	if got != want {
+		t.Fatalf("Generate = %q, want %q (order-1 backoff)", got, want)
+	}
+}
+
+func TestMuxGenerateCapsWords(t *testing.T) {
+	c := NewChain(1)
+	c.Build(strings.NewReader("a b c d e."))
+	mux := newMux(c, "", "")
+
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/generate?words=999999999", nil)
+	mux.ServeHTTP(rec, req)
+
+	var resp generateResponse
+	if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+		t.Fatalf("decode response: %v", err)
+	}
+	if got := len(strings.Fields(resp.Text)); got > maxGenerateWords {
+		t.Fatalf("generated %d words, want <= maxGenerateWords (%d)", got, maxGenerateWords)
+	}
+}
+
+func TestMuxGenerateRejectsMismatchedPrefix(t *testing.T) {
+	c := NewChain(2)
+	c.Build(strings.NewReader("a b c d e."))
+	mux := newMux(c, "", "")
+
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/generate?prefix=3", nil)
+	mux.ServeHTTP(rec, req)
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("prefix=3 against a 2-word chain: status = %d, want %d", rec.Code, http.StatusBadRequest)
+	}
+
+	rec = httptest.NewRecorder()
+	req = httptest.NewRequest(http.MethodGet, "/generate?prefix=2", nil)
+	mux.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("prefix=2 against a 2-word chain: status = %d, want %d", rec.Code, http.StatusOK)
+	}
+}
+
+func TestMuxTrainRequiresMatchingSecret(t *testing.T) {
+	c := NewChain(1)
+	mux := newMux(c, "", "sekret")
+
+	req := httptest.NewRequest(http.MethodPost, "/train", strings.NewReader("more text."))
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, req)
+	if rec.Code != http.StatusForbidden {
+		t.Fatalf("missing secret: status = %d, want %d", rec.Code, http.StatusForbidden)
+	}
+
+	req = httptest.NewRequest(http.MethodPost, "/train", strings.NewReader("more text."))
+	req.Header.Set("X-Ribbot-Secret", "sekret")
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, req)
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("matching secret: status = %d, want %d", rec.Code, http.StatusNoContent)
+	}
+}
+
+func TestMuxTrainCapsBodySize(t *testing.T) {
+	c := NewChain(1)
+	mux := newMux(c, "", "")
+
+	huge := strings.NewReader(strings.Repeat("word ", maxTrainBytes))
+	req := httptest.NewRequest(http.MethodPost, "/train", huge)
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, req)
+
+	total := 0
+	for _, dist := range c.chain {
+		total += len(dist.Suffixes)
+	}
+	if total == 0 {
+		t.Fatal("expected /train to ingest at least some words before hitting the body cap")
+	}
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}